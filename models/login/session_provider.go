@@ -0,0 +1,98 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package login
+
+import (
+	"code.gitea.io/gitea/models/db"
+	"code.gitea.io/gitea/modules/timeutil"
+)
+
+// SessionProvider records which underlying session provider currently owns
+// a given session ID, so the "virtual" session provider (see
+// modules/session) can keep routing a session to the backend it was
+// created under even after the configured provider changes.
+type SessionProvider struct {
+	Key      string `xorm:"pk CHAR(16)"`
+	Provider string `xorm:"VARCHAR(32) NOT NULL"`
+	Expiry   timeutil.TimeStamp
+}
+
+func init() {
+	db.RegisterModel(new(SessionProvider))
+}
+
+// GetSessionProvider returns the name of the provider that owns sid, or an
+// empty string if sid is not tracked yet or its mapping has expired.
+func GetSessionProvider(sid string) (string, error) {
+	var s SessionProvider
+	has, err := db.GetEngine(db.DefaultContext).ID(sid).Get(&s)
+	if err != nil || !has || s.Expiry <= timeutil.TimeStampNow() {
+		return "", err
+	}
+	return s.Provider, nil
+}
+
+// SetSessionProvider records, or updates, which provider owns sid.
+func SetSessionProvider(sid, provider string, maxLifetime int64) error {
+	s := &SessionProvider{
+		Key:      sid,
+		Provider: provider,
+		Expiry:   timeutil.TimeStampNow().Add(maxLifetime),
+	}
+
+	has, err := db.GetEngine(db.DefaultContext).ID(sid).Get(new(SessionProvider))
+	if err != nil {
+		return err
+	}
+	if has {
+		_, err = db.GetEngine(db.DefaultContext).ID(sid).Cols("provider", "expiry").Update(s)
+		return err
+	}
+
+	if _, err = db.GetEngine(db.DefaultContext).Insert(s); err == nil {
+		return nil
+	}
+
+	// Two concurrent first touches of the same brand new sid can both see
+	// has == false above and both reach this Insert; the loser doesn't
+	// get a real duplicate-key error back from every dialect, so fall
+	// back to an Update whenever the row exists now, rather than trying
+	// to recognize the error.
+	nowExists, getErr := db.GetEngine(db.DefaultContext).ID(sid).Get(new(SessionProvider))
+	if getErr != nil || !nowExists {
+		return err
+	}
+	_, err = db.GetEngine(db.DefaultContext).ID(sid).Cols("provider", "expiry").Update(s)
+	return err
+}
+
+// DeleteSessionProvider removes the provider mapping for sid, if any.
+func DeleteSessionProvider(sid string) error {
+	_, err := db.GetEngine(db.DefaultContext).ID(sid).Delete(new(SessionProvider))
+	return err
+}
+
+// RenameSessionProvider moves the mapping for oldsid to sid, keeping the
+// provider it was already assigned to and refreshing its TTL from
+// maxLifetime the same way SetSessionProvider does for a fresh mapping.
+func RenameSessionProvider(oldsid, sid string, maxLifetime int64) error {
+	provider, err := GetSessionProvider(oldsid)
+	if err != nil || provider == "" {
+		return err
+	}
+	if err := DeleteSessionProvider(oldsid); err != nil {
+		return err
+	}
+	return SetSessionProvider(sid, provider, maxLifetime)
+}
+
+// CleanupSessionProviders deletes every session_provider row whose TTL has
+// lapsed. Nothing else prunes this table, so without a periodic sweep it
+// would grow forever for the life of the installation; VirtualSessionProvider
+// calls this from its own GC.
+func CleanupSessionProviders() error {
+	_, err := db.GetEngine(db.DefaultContext).Where("expiry <= ?", timeutil.TimeStampNow()).Delete(new(SessionProvider))
+	return err
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package login
+
+import (
+	"sync"
+	"testing"
+
+	"code.gitea.io/gitea/models/db"
+	"code.gitea.io/gitea/models/unittest"
+	"code.gitea.io/gitea/modules/timeutil"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetSessionProviderConcurrentFirstTouch(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	sid := "concurrent-new-sid"
+	assert.NoError(t, DeleteSessionProvider(sid))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = SetSessionProvider(sid, "db", 3600)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+
+	provider, err := GetSessionProvider(sid)
+	assert.NoError(t, err)
+	assert.Equal(t, "db", provider)
+}
+
+func TestGetSessionProviderExpiredMappingIsIgnored(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	sid := "expired-sid"
+	assert.NoError(t, DeleteSessionProvider(sid))
+	assert.NoError(t, SetSessionProvider(sid, "redis", -10))
+
+	provider, err := GetSessionProvider(sid)
+	assert.NoError(t, err)
+	assert.Empty(t, provider, "an expired mapping must not be returned as the owner")
+}
+
+func TestRenameSessionProviderKeepsOwnerAndTTL(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	oldsid, sid := "rename-old-sid", "rename-new-sid"
+	assert.NoError(t, DeleteSessionProvider(oldsid))
+	assert.NoError(t, DeleteSessionProvider(sid))
+	assert.NoError(t, SetSessionProvider(oldsid, "memcache", 3600))
+
+	assert.NoError(t, RenameSessionProvider(oldsid, sid, 3600))
+
+	provider, err := GetSessionProvider(oldsid)
+	assert.NoError(t, err)
+	assert.Empty(t, provider, "the old sid must no longer be tracked")
+
+	provider, err = GetSessionProvider(sid)
+	assert.NoError(t, err)
+	assert.Equal(t, "memcache", provider, "Regenerate must keep the session on its existing owner")
+
+	var s SessionProvider
+	has, err := db.GetEngine(db.DefaultContext).ID(sid).Get(&s)
+	assert.NoError(t, err)
+	assert.True(t, has)
+	assert.True(t, s.Expiry > timeutil.TimeStampNow(), "a rename must carry over a real TTL, not Expiry=now")
+}
@@ -0,0 +1,27 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"gitea.com/go-chi/session"
+	"gitea.com/go-chi/session/file"
+	"gitea.com/go-chi/session/memcache"
+	"gitea.com/go-chi/session/redis"
+)
+
+// init registers the providers that ship with go-chi/session itself as
+// virtual sub-providers, alongside the db/ssdb providers that register
+// themselves. go-chi/session's own Register only makes a provider usable
+// directly; it says nothing to virtualFactories, so without this,
+// provider=redis or provider=memcache in app.ini — the exact "migrate away
+// from the old provider" scenario virtual exists for — would fail Init with
+// "unknown sub-provider", even though those names work fine outside of
+// virtual.
+func init() {
+	RegisterVirtualFactory("memory", func() session.Provider { return &session.MemProvider{} })
+	RegisterVirtualFactory("file", func() session.Provider { return &file.FileProvider{} })
+	RegisterVirtualFactory("redis", func() session.Provider { return &redis.RedisProvider{} })
+	RegisterVirtualFactory("memcache", func() session.Provider { return &memcache.MemcacheProvider{} })
+}
@@ -0,0 +1,549 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.gitea.io/gitea/modules/graceful"
+	"code.gitea.io/gitea/modules/log"
+
+	"gitea.com/go-chi/session"
+)
+
+// cachedEntry is the unit kept in a CachedProvider's LRU: the session's
+// live, mutable data plus bookkeeping to tell whether it still matches what
+// was last written to the inner provider.
+type cachedEntry struct {
+	sid string
+
+	lock        sync.Mutex
+	data        map[interface{}]interface{}
+	flushedHash [sha256.Size]byte
+	dirty       bool
+	destroyed   bool
+}
+
+// lru is a minimal in-process least-recently-used cache keyed by session
+// ID. CachedProvider only needs bounded-size eviction, so a small
+// container/list-backed cache avoids pulling in a dependency for it.
+type lru struct {
+	lock     sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRU(capacity int) *lru {
+	return &lru{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lru) get(sid string) (*cachedEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.items[sid]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cachedEntry), true
+}
+
+// getOrSet returns the existing entry for sid if present, otherwise it
+// inserts and returns entry, evicting the least-recently-used entry if the
+// cache is now over capacity. An evicted entry that still has a pending
+// write is flushed first, via flushBeforeEvict, so a bounded cache_size
+// under load can't silently drop a write the way it would if eviction just
+// threw the entry away.
+func (c *lru) getOrSet(sid string, entry *cachedEntry, flushBeforeEvict func(*cachedEntry) error) *cachedEntry {
+	c.lock.Lock()
+
+	if el, ok := c.items[sid]; ok {
+		c.ll.MoveToFront(el)
+		existing := el.Value.(*cachedEntry)
+		c.lock.Unlock()
+		return existing
+	}
+
+	el := c.ll.PushFront(entry)
+	c.items[sid] = el
+
+	var evicted []*cachedEntry
+	for c.capacity > 0 && c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		evictedEntry := oldest.Value.(*cachedEntry)
+		delete(c.items, evictedEntry.sid)
+		evicted = append(evicted, evictedEntry)
+	}
+	c.lock.Unlock()
+
+	for _, evictedEntry := range evicted {
+		evictedEntry.lock.Lock()
+		dirty := evictedEntry.dirty
+		evictedEntry.lock.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := flushBeforeEvict(evictedEntry); err != nil {
+			log.Error("session/cached: error flushing sid %s before evicting it from the cache: %v", evictedEntry.sid, err)
+		}
+	}
+
+	return entry
+}
+
+// delete removes sid from the cache and returns its entry, if it had one, so
+// the caller can mark it destroyed and stop a racing debounced flush from
+// writing it back to the inner provider.
+func (c *lru) delete(sid string) *cachedEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.items[sid]
+	if !ok {
+		return nil
+	}
+	c.ll.Remove(el)
+	delete(c.items, sid)
+	return el.Value.(*cachedEntry)
+}
+
+func (c *lru) rename(oldsid, sid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.items[oldsid]
+	if !ok {
+		return
+	}
+	delete(c.items, oldsid)
+	entry := el.Value.(*cachedEntry)
+	entry.sid = sid
+	c.items[sid] = el
+}
+
+func (c *lru) values() []*cachedEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	out := make([]*cachedEntry, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		out = append(out, el.Value.(*cachedEntry))
+	}
+	return out
+}
+
+// canonicalHash returns a hash of data that is stable across calls as long
+// as the map itself is unchanged, independent of whatever Codec is
+// configured for at-rest storage. This matters because encoding/gob's map
+// encoder walks the map in the same randomized order Go's own `range`
+// does, so hashing a GobCodec-encoded payload (the default codec) gives a
+// different result on every call even when nothing changed, defeating the
+// whole point of comparing against flushedHash. fmt's "%v" verb, unlike
+// gob, sorts map keys, so building the hash input that way is stable.
+func canonicalHash(data map[interface{}]interface{}) ([sha256.Size]byte, error) {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		sk, ok := k.(string)
+		if !ok {
+			return [sha256.Size]byte{}, fmt.Errorf("session/cached: non-string session key %v", k)
+		}
+		keys = append(keys, sk)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%q=%v;", k, data[k])
+	}
+
+	var out [sha256.Size]byte
+	copy(out[:], h.Sum(nil))
+	return out, nil
+}
+
+// CachedStore wraps a session's cached entry. Set/Get/Delete operate on the
+// in-memory map directly, the same way DBStore and SSDBStore do; Release
+// decides whether the change is worth flushing to the inner provider.
+type CachedStore struct {
+	p     *CachedProvider
+	entry *cachedEntry
+}
+
+// Set sets value to given key in session.
+func (s *CachedStore) Set(key, val interface{}) error {
+	s.entry.lock.Lock()
+	defer s.entry.lock.Unlock()
+
+	s.entry.data[key] = val
+	return nil
+}
+
+// Get gets value by given key in session.
+func (s *CachedStore) Get(key interface{}) interface{} {
+	s.entry.lock.Lock()
+	defer s.entry.lock.Unlock()
+
+	return s.entry.data[key]
+}
+
+// Delete delete a key from session.
+func (s *CachedStore) Delete(key interface{}) error {
+	s.entry.lock.Lock()
+	defer s.entry.lock.Unlock()
+
+	delete(s.entry.data, key)
+	return nil
+}
+
+// ID returns current session ID.
+func (s *CachedStore) ID() string {
+	return s.entry.sid
+}
+
+// Release marks the cached entry dirty and, unless a debounce interval is
+// configured, flushes it to the inner provider right away. A canonical hash
+// of the data is compared against the one last flushed so a request that
+// never actually changed its session data doesn't generate a write. This
+// has to run the same comparison when the data is now empty as when it
+// isn't: a session that went from holding data to holding none (every key
+// deleted) still differs from what's flushed and needs to clear the inner
+// store, just like one that never held anything still matches it and
+// shouldn't.
+func (s *CachedStore) Release() error {
+	s.entry.lock.Lock()
+
+	hash, err := canonicalHash(s.entry.data)
+	if err != nil {
+		s.entry.lock.Unlock()
+		return err
+	}
+
+	if hash == s.entry.flushedHash {
+		s.entry.lock.Unlock()
+		return nil
+	}
+	s.entry.dirty = true
+	s.entry.lock.Unlock()
+
+	if s.p.debounce > 0 {
+		return nil
+	}
+	return s.p.flush(s.entry)
+}
+
+// Flush deletes all session data.
+func (s *CachedStore) Flush() error {
+	s.entry.lock.Lock()
+	defer s.entry.lock.Unlock()
+
+	s.entry.data = make(map[interface{}]interface{})
+	return nil
+}
+
+// CachedProvider wraps another session.Provider with a write-through
+// in-process LRU, so the workloads that make real deployments move off
+// DBProvider (a DB write on every request via Release, and a DB read on
+// every request via Read) don't have to hit the inner provider nearly as
+// often. Register it as "cached" with `inner=db;inner_config=...` to sit it
+// in front of an existing provider without changing that provider at all.
+type CachedProvider struct {
+	inner    session.Provider
+	cache    *lru
+	debounce time.Duration
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Init initializes the cached session provider.
+// connStr: inner=db;inner_config=codec=secure-json;cache_size=10000;debounce=2s
+func (p *CachedProvider) Init(maxLifetime int64, connStr string) error {
+	params := parseConnStrParams(connStr)
+
+	innerName := params["inner"]
+	if innerName == "" {
+		return fmt.Errorf("session/cached: connStr is missing inner=")
+	}
+	factory, ok := virtualFactories[innerName]
+	if !ok {
+		return fmt.Errorf("session/cached: unknown inner provider %q", innerName)
+	}
+	inner := factory()
+	if err := inner.Init(maxLifetime, params["inner_config"]); err != nil {
+		return err
+	}
+	p.inner = inner
+
+	var err error
+	cacheSize := 0
+	if v := params["cache_size"]; v != "" {
+		cacheSize, err = strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("session/cached: invalid cache_size %q: %w", v, err)
+		}
+	}
+	p.cache = newLRU(cacheSize)
+
+	if v := params["debounce"]; v != "" {
+		p.debounce, err = time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("session/cached: invalid debounce %q: %w", v, err)
+		}
+	}
+
+	p.stopCh = make(chan struct{})
+	if p.debounce > 0 {
+		p.wg.Add(1)
+		go p.debounceLoop()
+	}
+
+	graceful.GetManager().RunAtTerminate(context.Background(), func() {
+		if err := p.Close(); err != nil {
+			log.Error("session/cached: error flushing pending writes at shutdown: %v", err)
+		}
+	})
+
+	return nil
+}
+
+func (p *CachedProvider) debounceLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.debounce)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.flushDirty()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *CachedProvider) flushDirty() {
+	for _, entry := range p.cache.values() {
+		entry.lock.Lock()
+		dirty := entry.dirty
+		entry.lock.Unlock()
+		if !dirty {
+			continue
+		}
+		if err := p.flush(entry); err != nil {
+			log.Error("session/cached: error flushing sid %s: %v", entry.sid, err)
+		}
+	}
+}
+
+// flush writes entry's current data to the inner provider if it is still
+// marked dirty, then records the hash that was flushed. entry.lock is held
+// for the whole round trip, not just the bookkeeping, so this can't
+// interleave with CachedProvider.Destroy: either Destroy's own inner.Destroy
+// call runs first and this sees entry.destroyed and no-ops, or it runs after
+// this returns and removes whatever was just flushed. Without that, a
+// logout racing a debounced flush of the same session could have the flush
+// resurrect the session in the inner provider right after Destroy removed it.
+func (p *CachedProvider) flush(entry *cachedEntry) error {
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if !entry.dirty || entry.destroyed {
+		return nil
+	}
+	data := make(map[interface{}]interface{}, len(entry.data))
+	for k, v := range entry.data {
+		data[k] = v
+	}
+
+	hash, err := canonicalHash(data)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		// DBStore.Release and SSDBStore.Release are both no-ops on an
+		// empty map, so a Read+Flush+Release here would silently leave
+		// the inner store's last write in place instead of clearing it.
+		if err := p.inner.Destroy(entry.sid); err != nil {
+			return err
+		}
+	} else {
+		// Read then Flush rather than Destroy then Read: Flush clears
+		// the store's in-memory map without a round trip to the inner
+		// store on its own, giving the same "start from empty so
+		// deleted keys don't linger forever" semantics as Destroy+Read
+		// in 2 round trips instead of 3. That matters here specifically
+		// because cutting inner-store traffic is the whole point of
+		// this provider.
+		raw, err := p.inner.Read(entry.sid)
+		if err != nil {
+			return err
+		}
+		if err := raw.Flush(); err != nil {
+			return err
+		}
+		for k, v := range data {
+			if err := raw.Set(k, v); err != nil {
+				return err
+			}
+		}
+		if err := raw.Release(); err != nil {
+			return err
+		}
+	}
+
+	entry.flushedHash = hash
+	entry.dirty = false
+	return nil
+}
+
+// Read returns raw session store by session ID, populating the cache from
+// the inner provider on a miss.
+func (p *CachedProvider) Read(sid string) (session.RawStore, error) {
+	if entry, ok := p.cache.get(sid); ok {
+		return &CachedStore{p: p, entry: entry}, nil
+	}
+
+	raw, err := p.inner.Read(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := rawStoreData(raw)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := canonicalHash(data)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := p.cache.getOrSet(sid, &cachedEntry{
+		sid:         sid,
+		data:        data,
+		flushedHash: hash,
+	}, p.flush)
+	return &CachedStore{p: p, entry: entry}, nil
+}
+
+// Exist returns true if session with given ID exists, preferring the cache
+// so a hot session doesn't round-trip to the inner provider just to check.
+func (p *CachedProvider) Exist(sid string) bool {
+	if _, ok := p.cache.get(sid); ok {
+		return true
+	}
+	return p.inner.Exist(sid)
+}
+
+// Destroy deletes a session by session ID from both the cache and the
+// inner provider.
+func (p *CachedProvider) Destroy(sid string) error {
+	if entry := p.cache.delete(sid); entry != nil {
+		entry.lock.Lock()
+		entry.destroyed = true
+		entry.lock.Unlock()
+	}
+	return p.inner.Destroy(sid)
+}
+
+// Regenerate regenerates a session store from old session ID to new one.
+func (p *CachedProvider) Regenerate(oldsid, sid string) (session.RawStore, error) {
+	raw, err := p.inner.Regenerate(oldsid, sid)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.cache.get(oldsid); ok {
+		p.cache.rename(oldsid, sid)
+		entry, _ := p.cache.get(sid)
+		return &CachedStore{p: p, entry: entry}, nil
+	}
+
+	data, err := rawStoreData(raw)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := canonicalHash(data)
+	if err != nil {
+		return nil, err
+	}
+	entry := p.cache.getOrSet(sid, &cachedEntry{
+		sid:         sid,
+		data:        data,
+		flushedHash: hash,
+	}, p.flush)
+	return &CachedStore{p: p, entry: entry}, nil
+}
+
+// Count counts and returns number of sessions known to the inner provider.
+// A session that only exists in the cache so far (not yet flushed) is
+// counted only if the inner provider's Read already created it there, as
+// DBProvider's does; SSDBProvider's Read writes nothing, so such a session
+// is not counted under it.
+func (p *CachedProvider) Count() int {
+	return p.inner.Count()
+}
+
+// GC flushes any pending writes and then delegates garbage collection to
+// the inner provider.
+func (p *CachedProvider) GC() {
+	p.flushDirty()
+	p.inner.GC()
+}
+
+// Close stops the debounce loop, if any, and drains every pending write to
+// the inner provider. The Gitea shutdown sequence calls this (registered
+// via graceful.GetManager().RunAtTerminate in Init) so a debounced write
+// is never silently lost on restart.
+func (p *CachedProvider) Close() error {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+	p.wg.Wait()
+
+	var firstErr error
+	for _, entry := range p.cache.values() {
+		if err := p.flush(entry); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// rawStoreData copies the key/value pairs out of the inner provider's
+// store. The inner provider must hand its store back as a DataStore: there
+// is no safe way to seed the cache from a store we can't read in bulk, and
+// silently defaulting to an empty map would make the next flush destroy
+// whatever the session actually held.
+func rawStoreData(raw session.RawStore) (map[interface{}]interface{}, error) {
+	ds, ok := raw.(DataStore)
+	if !ok {
+		return nil, fmt.Errorf("session/cached: inner store %T does not implement session.DataStore", raw)
+	}
+	return ds.Data(), nil
+}
+
+func init() {
+	session.Register("cached", &CachedProvider{})
+}
@@ -0,0 +1,196 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"testing"
+
+	"gitea.com/go-chi/session"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore is a bare in-memory session.RawStore/DataStore used to exercise
+// CachedProvider without a real DB or network round trip.
+type fakeStore struct {
+	p    *fakeProvider
+	sid  string
+	data map[interface{}]interface{}
+}
+
+func (s *fakeStore) Set(key, val interface{}) error {
+	s.data[key] = val
+	return nil
+}
+
+func (s *fakeStore) Get(key interface{}) interface{} { return s.data[key] }
+
+func (s *fakeStore) Delete(key interface{}) error {
+	delete(s.data, key)
+	return nil
+}
+
+func (s *fakeStore) ID() string { return s.sid }
+
+func (s *fakeStore) Release() error {
+	// Mirrors DBStore.Release/SSDBStore.Release: a no-op on an empty map,
+	// so tests exercising CachedProvider.flush see the same "Release
+	// alone can't clear a session" behavior the real stores have.
+	if len(s.data) == 0 {
+		return nil
+	}
+	cp := make(map[interface{}]interface{}, len(s.data))
+	for k, v := range s.data {
+		cp[k] = v
+	}
+	s.p.released[s.sid] = cp
+	s.p.releaseCount++
+	return nil
+}
+
+func (s *fakeStore) Flush() error {
+	s.data = make(map[interface{}]interface{})
+	return nil
+}
+
+func (s *fakeStore) Data() map[interface{}]interface{} { return s.data }
+
+// fakeProvider is a minimal session.Provider standing in for DBProvider in
+// tests, so CachedProvider's own logic (eviction, dirty-hash, flush) can be
+// exercised without a DB fixture.
+type fakeProvider struct {
+	data         map[string]map[interface{}]interface{}
+	released     map[string]map[interface{}]interface{}
+	releaseCount int
+	destroyCount int
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{
+		data:     make(map[string]map[interface{}]interface{}),
+		released: make(map[string]map[interface{}]interface{}),
+	}
+}
+
+func (p *fakeProvider) Init(maxLifetime int64, connStr string) error { return nil }
+
+func (p *fakeProvider) Read(sid string) (session.RawStore, error) {
+	kv, ok := p.data[sid]
+	if !ok {
+		kv = make(map[interface{}]interface{})
+		p.data[sid] = kv
+	}
+	cp := make(map[interface{}]interface{}, len(kv))
+	for k, v := range kv {
+		cp[k] = v
+	}
+	return &fakeStore{p: p, sid: sid, data: cp}, nil
+}
+
+func (p *fakeProvider) Exist(sid string) bool {
+	_, ok := p.data[sid]
+	return ok
+}
+
+func (p *fakeProvider) Destroy(sid string) error {
+	delete(p.data, sid)
+	p.destroyCount++
+	return nil
+}
+
+func (p *fakeProvider) Regenerate(oldsid, sid string) (session.RawStore, error) {
+	p.data[sid] = p.data[oldsid]
+	delete(p.data, oldsid)
+	return p.Read(sid)
+}
+
+func (p *fakeProvider) Count() int { return len(p.data) }
+
+func (p *fakeProvider) GC() {}
+
+func newTestCachedProvider(t *testing.T, fake *fakeProvider, connStr string) *CachedProvider {
+	t.Helper()
+	RegisterVirtualFactory("fake-test", func() session.Provider { return fake })
+
+	p := &CachedProvider{}
+	assert.NoError(t, p.Init(3600, "inner=fake-test;"+connStr))
+	return p
+}
+
+func TestCachedProviderEvictionFlushesDirtyEntry(t *testing.T) {
+	fake := newFakeProvider()
+	p := newTestCachedProvider(t, fake, "cache_size=1;debounce=1h")
+
+	raw, err := p.Read("sid-a")
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Set("k", "v1"))
+	assert.NoError(t, raw.Release())
+
+	// sid-a is now dirty but, thanks to the long debounce, not yet flushed.
+	// Reading a second session with cache_size=1 evicts it.
+	_, err = p.Read("sid-b")
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[interface{}]interface{}{"k": "v1"}, fake.released["sid-a"])
+}
+
+func TestCachedProviderFlushClearsInnerStoreWhenEmptied(t *testing.T) {
+	fake := newFakeProvider()
+	p := newTestCachedProvider(t, fake, "cache_size=1;debounce=1h")
+
+	raw, err := p.Read("sid-d")
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Set("k", "v1"))
+	assert.NoError(t, raw.Release())
+
+	raw, err = p.Read("sid-d")
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Delete("k"))
+	assert.NoError(t, raw.Release())
+
+	// sid-d is dirty with an now-empty map and, thanks to the long
+	// debounce, not yet flushed. Evicting it via cache_size=1 must clear
+	// it from the inner store rather than leaving "k": "v1" in place: a
+	// Read+Flush+Release sequence would no-op on the empty map the same
+	// way a real DBStore/SSDBStore does, silently keeping the stale write.
+	_, err = p.Read("sid-e")
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, fake.destroyCount)
+	_, exists := fake.data["sid-d"]
+	assert.False(t, exists, "an emptied session must be cleared from the inner store on flush")
+}
+
+func TestCachedProviderFlushClearsInnerStoreOnSingleEmptyingRelease(t *testing.T) {
+	fake := newFakeProvider()
+	fake.data["sid-f"] = map[interface{}]interface{}{"user": "foo"}
+	p := newTestCachedProvider(t, fake, "")
+
+	raw, err := p.Read("sid-f")
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Delete("user"))
+	assert.NoError(t, raw.Release())
+
+	assert.Equal(t, 1, fake.destroyCount)
+	_, exists := fake.data["sid-f"]
+	assert.False(t, exists, "clearing every key in one Release must still flush the now-empty session")
+}
+
+func TestCachedProviderSkipsNoopRelease(t *testing.T) {
+	fake := newFakeProvider()
+	p := newTestCachedProvider(t, fake, "")
+
+	raw, err := p.Read("sid-c")
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Set("k", "v1"))
+	assert.NoError(t, raw.Release())
+	assert.Equal(t, 1, fake.releaseCount)
+
+	raw, err = p.Read("sid-c")
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Set("k", "v1")) // unchanged
+	assert.NoError(t, raw.Release())
+	assert.Equal(t, 1, fake.releaseCount, "a no-op change must not flush again")
+}
@@ -0,0 +1,299 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"gitea.com/go-chi/session"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// sessionCodecMagic prefixes every payload written through a Codec below,
+// so DecodeSessionData can tell it apart from the raw gob blobs written by
+// providers before this package gained pluggable codecs. A gob stream never
+// starts with these four bytes, so old rows keep decoding correctly during
+// rollout.
+var sessionCodecMagic = []byte("GSC1")
+
+const (
+	codecGob byte = iota + 1
+	codecJSON
+	codecSecure
+)
+
+// Codec encodes a session's key/value map for storage. Decoding is not part
+// of the interface: DecodeSessionData reads the codec id every Codec writes
+// and decodes any of them. Every
+// provider in this package shares the same Codec plumbing, so encryption
+// and the choice of wire format are cross-cutting capabilities rather than
+// something each backend has to implement on its own.
+type Codec interface {
+	Encode(data map[interface{}]interface{}) ([]byte, error)
+}
+
+// GobCodec is the original encoding: compact, but unreadable outside Go and
+// stored in cleartext. Kept as the default for backwards compatibility.
+type GobCodec struct{}
+
+// Encode implements Codec.
+func (GobCodec) Encode(data map[interface{}]interface{}) ([]byte, error) {
+	body, err := session.EncodeGob(data)
+	if err != nil {
+		return nil, err
+	}
+	return tagPayload(codecGob, body), nil
+}
+
+// JSONCodec stores sessions as JSON so operators can inspect payloads with
+// non-Go tooling. Only string keys are supported, which covers every
+// session key Gitea itself uses.
+//
+// encoding/json has no way to tell an int64 from a float64 once it's back
+// in an interface{}, so each value is tagged with the concrete Go type it
+// was stored as and re-typed on the way out; a type this package doesn't
+// know about is a hard error rather than a silent round-trip to the wrong
+// type (e.g. a session.Get("uid").(int64) type assertion panicking).
+type JSONCodec struct{}
+
+// jsonValue is the on-the-wire shape of a single session value under
+// JSONCodec: its original Go type plus the JSON encoding of the value
+// itself.
+type jsonValue struct {
+	Type string          `json:"t"`
+	Data json.RawMessage `json:"v"`
+}
+
+// Encode implements Codec.
+func (JSONCodec) Encode(data map[interface{}]interface{}) ([]byte, error) {
+	m := make(map[string]jsonValue, len(data))
+	for k, v := range data {
+		sk, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("session/json: non-string session key %v", k)
+		}
+		jv, err := encodeJSONValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("session/json: key %q: %w", sk, err)
+		}
+		m[sk] = jv
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return tagPayload(codecJSON, body), nil
+}
+
+// encodeJSONValue tags v with its concrete Go type so decodeJSONValue can
+// restore it exactly, instead of getting back whatever encoding/json
+// defaults to (e.g. float64 for every JSON number).
+func encodeJSONValue(v interface{}) (jsonValue, error) {
+	var typeName string
+	switch v.(type) {
+	case string:
+		typeName = "string"
+	case bool:
+		typeName = "bool"
+	case int:
+		typeName = "int"
+	case int64:
+		typeName = "int64"
+	case float64:
+		typeName = "float64"
+	default:
+		return jsonValue{}, fmt.Errorf("unsupported session value type %T", v)
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return jsonValue{}, err
+	}
+	return jsonValue{Type: typeName, Data: raw}, nil
+}
+
+func decodeJSONValue(jv jsonValue) (interface{}, error) {
+	switch jv.Type {
+	case "string":
+		var s string
+		err := json.Unmarshal(jv.Data, &s)
+		return s, err
+	case "bool":
+		var b bool
+		err := json.Unmarshal(jv.Data, &b)
+		return b, err
+	case "int":
+		var n int
+		err := json.Unmarshal(jv.Data, &n)
+		return n, err
+	case "int64":
+		var n int64
+		err := json.Unmarshal(jv.Data, &n)
+		return n, err
+	case "float64":
+		var f float64
+		err := json.Unmarshal(jv.Data, &f)
+		return f, err
+	default:
+		return nil, fmt.Errorf("unknown session value type %q", jv.Type)
+	}
+}
+
+func decodeJSON(payload []byte) (map[interface{}]interface{}, error) {
+	var m map[string]jsonValue
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, err
+	}
+
+	kv := make(map[interface{}]interface{}, len(m))
+	for k, jv := range m {
+		v, err := decodeJSONValue(jv)
+		if err != nil {
+			return nil, fmt.Errorf("session/json: key %q: %w", k, err)
+		}
+		kv[k] = v
+	}
+	return kv, nil
+}
+
+// SecureCodec wraps another Codec with AES-GCM, deriving its key from
+// [security] SECRET_KEY via HKDF so operators don't need to provision a
+// separate encryption key.
+type SecureCodec struct {
+	Inner Codec
+}
+
+func secureCodecKey() ([]byte, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, []byte(setting.SecretKey), nil, []byte("gitea-session-codec"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func secureCodecGCM() (cipher.AEAD, error) {
+	key, err := secureCodecKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encode implements Codec.
+func (c SecureCodec) Encode(data map[interface{}]interface{}) ([]byte, error) {
+	inner := c.Inner
+	if inner == nil {
+		inner = GobCodec{}
+	}
+
+	plain, err := inner.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := secureCodecGCM()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, plain, nil)
+	return tagPayload(codecSecure, ciphertext), nil
+}
+
+func decodeSecure(payload []byte) (map[interface{}]interface{}, error) {
+	gcm, err := secureCodecGCM()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(payload) < gcm.NonceSize() {
+		return nil, fmt.Errorf("session/secure: payload shorter than a nonce")
+	}
+	nonce, ciphertext := payload[:gcm.NonceSize()], payload[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeSessionData(plain)
+}
+
+// tagPayload prepends the shared magic and a codec id so DecodeSessionData
+// can later tell how to decode the payload.
+func tagPayload(id byte, body []byte) []byte {
+	out := make([]byte, 0, len(sessionCodecMagic)+1+len(body))
+	out = append(out, sessionCodecMagic...)
+	out = append(out, id)
+	return append(out, body...)
+}
+
+// DecodeSessionData decodes a payload written by any Codec below, as well
+// as the raw gob blobs every provider wrote before pluggable codecs
+// existed. This lets a codec rollout happen gradually: rows written before
+// the change keep decoding correctly no matter what `codec=` is configured
+// now.
+func DecodeSessionData(payload []byte) (map[interface{}]interface{}, error) {
+	if !bytes.HasPrefix(payload, sessionCodecMagic) {
+		return session.DecodeGob(payload)
+	}
+
+	rest := payload[len(sessionCodecMagic):]
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("session: truncated codec payload")
+	}
+
+	id, body := rest[0], rest[1:]
+	switch id {
+	case codecGob:
+		return session.DecodeGob(body)
+	case codecJSON:
+		return decodeJSON(body)
+	case codecSecure:
+		return decodeSecure(body)
+	default:
+		return nil, fmt.Errorf("session: unknown codec id %d", id)
+	}
+}
+
+// NewCodec builds a Codec from a `codec=` connStr parameter: "gob"
+// (default) for the legacy encoding, "json" for inspectable payloads,
+// "secure" (or "secure-gob") for AES-GCM over gob, and "secure-json" for
+// AES-GCM over JSON.
+func NewCodec(name string) (Codec, error) {
+	switch name {
+	case "", "gob":
+		return GobCodec{}, nil
+	case "json":
+		return JSONCodec{}, nil
+	case "secure", "secure-gob":
+		return SecureCodec{Inner: GobCodec{}}, nil
+	case "secure-json":
+		return SecureCodec{Inner: JSONCodec{}}, nil
+	default:
+		return nil, fmt.Errorf("session: unknown codec %q", name)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/modules/setting"
+
+	"gitea.com/go-chi/session"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	setting.SecretKey = "test-secret-key"
+
+	data := map[interface{}]interface{}{
+		"uid":    int64(42),
+		"uname":  "gitea",
+		"signed": true,
+	}
+
+	for _, name := range []string{"gob", "json", "secure", "secure-json"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := NewCodec(name)
+			assert.NoError(t, err)
+
+			encoded, err := codec.Encode(data)
+			assert.NoError(t, err)
+
+			decoded, err := DecodeSessionData(encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, data, decoded)
+		})
+	}
+}
+
+func TestDecodeSessionDataLegacyGob(t *testing.T) {
+	data := map[interface{}]interface{}{"uid": int64(7)}
+
+	legacy, err := session.EncodeGob(data)
+	assert.NoError(t, err)
+
+	decoded, err := DecodeSessionData(legacy)
+	assert.NoError(t, err)
+	assert.EqualValues(t, data, decoded)
+}
+
+func TestNewCodecUnknown(t *testing.T) {
+	_, err := NewCodec("made-up")
+	assert.Error(t, err)
+}
@@ -0,0 +1,21 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import "strings"
+
+// parseConnStrParams parses the `key=value;key=value` option format shared
+// by the providers in this package (on top of whatever bare connection
+// string a given backend also needs).
+func parseConnStrParams(connStr string) map[string]string {
+	params := make(map[string]string)
+	for _, field := range strings.Split(connStr, ";") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+	return params
+}
@@ -16,16 +16,18 @@ import (
 
 // DBStore represents a session store implementation based on the DB.
 type DBStore struct {
-	sid  string
-	lock sync.RWMutex
-	data map[interface{}]interface{}
+	sid   string
+	codec Codec
+	lock  sync.RWMutex
+	data  map[interface{}]interface{}
 }
 
 // NewDBStore creates and returns a DB session store.
-func NewDBStore(sid string, kv map[interface{}]interface{}) *DBStore {
+func NewDBStore(sid string, codec Codec, kv map[interface{}]interface{}) *DBStore {
 	return &DBStore{
-		sid:  sid,
-		data: kv,
+		sid:   sid,
+		codec: codec,
+		data:  kv,
 	}
 }
 
@@ -60,6 +62,14 @@ func (s *DBStore) ID() string {
 	return s.sid
 }
 
+// Data implements session.DataStore.
+func (s *DBStore) Data() map[interface{}]interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.data
+}
+
 // Release releases resource and save data to provider.
 func (s *DBStore) Release() error {
 	// Skip encoding if the data is empty
@@ -67,7 +77,7 @@ func (s *DBStore) Release() error {
 		return nil
 	}
 
-	data, err := session.EncodeGob(s.data)
+	data, err := s.codec.Encode(s.data)
 	if err != nil {
 		return err
 	}
@@ -87,12 +97,19 @@ func (s *DBStore) Flush() error {
 // DBProvider represents a DB session provider implementation.
 type DBProvider struct {
 	maxLifetime int64
+	codec       Codec
 }
 
 // Init initializes DB session provider.
-// connStr: username:password@protocol(address)/dbname?param=value
+// connStr: username:password@protocol(address)/dbname?param=value;codec=secure-json
 func (p *DBProvider) Init(maxLifetime int64, connStr string) error {
 	p.maxLifetime = maxLifetime
+
+	codec, err := NewCodec(parseConnStrParams(connStr)["codec"])
+	if err != nil {
+		return err
+	}
+	p.codec = codec
 	return nil
 }
 
@@ -107,13 +124,13 @@ func (p *DBProvider) Read(sid string) (session.RawStore, error) {
 	if len(s.Data) == 0 || s.Expiry.Add(p.maxLifetime) <= timeutil.TimeStampNow() {
 		kv = make(map[interface{}]interface{})
 	} else {
-		kv, err = session.DecodeGob(s.Data)
+		kv, err = DecodeSessionData(s.Data)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return NewDBStore(sid, kv), nil
+	return NewDBStore(sid, p.codec, kv), nil
 }
 
 // Exist returns true if session with given ID exists.
@@ -142,13 +159,13 @@ func (p *DBProvider) Regenerate(oldsid, sid string) (_ session.RawStore, err err
 	if len(s.Data) == 0 || s.Expiry.Add(p.maxLifetime) <= timeutil.TimeStampNow() {
 		kv = make(map[interface{}]interface{})
 	} else {
-		kv, err = session.DecodeGob(s.Data)
+		kv, err = DecodeSessionData(s.Data)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return NewDBStore(sid, kv), nil
+	return NewDBStore(sid, p.codec, kv), nil
 }
 
 // Count counts and returns number of sessions.
@@ -169,4 +186,5 @@ func (p *DBProvider) GC() {
 
 func init() {
 	session.Register("db", &DBProvider{})
+	RegisterVirtualFactory("db", func() session.Provider { return &DBProvider{} })
 }
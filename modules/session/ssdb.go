@@ -0,0 +1,322 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gitea.com/go-chi/session"
+)
+
+// ssdbDefaultPoolSize is how many concurrent SSDB connections a provider
+// opens when connStr doesn't override it with pool_size=.
+const ssdbDefaultPoolSize = 10
+
+// ssdbConn wraps a single connection to an SSDB server, reconnecting lazily
+// on error instead of panicking so a transient hiccup does not take down
+// the request that happens to hit it.
+type ssdbConn struct {
+	addr string
+
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func newSSDBConn(addr string) *ssdbConn {
+	return &ssdbConn{addr: addr}
+}
+
+func (c *ssdbConn) do(args ...string) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.Dial("tcp", c.addr)
+		if err != nil {
+			return nil, fmt.Errorf("session/ssdb: dial %s: %w", c.addr, err)
+		}
+		c.conn = conn
+	}
+
+	if err := ssdbSend(c.conn, args); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+
+	resp, err := ssdbRecv(c.conn)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ssdbPool is a small fixed-size pool of ssdbConn, one of which is checked
+// out for the duration of a single do() call. A single shared connection
+// behind one mutex would serialize every SSDB operation across the whole
+// process onto one socket, which defeats the point of an SSDB-backed
+// provider under a session-heavy workload.
+type ssdbPool struct {
+	conns chan *ssdbConn
+}
+
+func newSSDBPool(addr string, size int) *ssdbPool {
+	conns := make(chan *ssdbConn, size)
+	for i := 0; i < size; i++ {
+		conns <- newSSDBConn(addr)
+	}
+	return &ssdbPool{conns: conns}
+}
+
+func (p *ssdbPool) do(args ...string) ([]string, error) {
+	conn := <-p.conns
+	defer func() { p.conns <- conn }()
+	return conn.do(args...)
+}
+
+func ssdbSend(conn net.Conn, args []string) error {
+	var buf strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "%d\n%s\n", len(arg), arg)
+	}
+	buf.WriteString("\n")
+	_, err := conn.Write([]byte(buf.String()))
+	return err
+}
+
+// ssdbRecv reads one SSDB response block: a sequence of "<size>\n<data>\n"
+// pairs terminated by an empty line.
+func ssdbRecv(conn net.Conn) ([]string, error) {
+	reader := bufio.NewReader(conn)
+
+	var resp []string
+	for {
+		sizeLine, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeLine = strings.TrimRight(sizeLine, "\r\n")
+		if sizeLine == "" {
+			break
+		}
+
+		n := 0
+		if _, err := fmt.Sscanf(sizeLine, "%d", &n); err != nil {
+			return nil, fmt.Errorf("session/ssdb: malformed size header %q", sizeLine)
+		}
+
+		data := make([]byte, n)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		if _, err := reader.ReadString('\n'); err != nil { // trailing newline
+			return nil, err
+		}
+
+		resp = append(resp, string(data))
+	}
+	return resp, nil
+}
+
+// SSDBStore represents an SSDB session store: the whole session map is kept
+// behind a single key, encoded with the provider's Codec, with SSDB's own
+// TTL handling expiry.
+type SSDBStore struct {
+	p    *SSDBProvider
+	sid  string
+	lock sync.RWMutex
+	data map[interface{}]interface{}
+}
+
+// NewSSDBStore creates and returns an SSDB session store.
+func NewSSDBStore(p *SSDBProvider, sid string, kv map[interface{}]interface{}) *SSDBStore {
+	return &SSDBStore{
+		p:    p,
+		sid:  sid,
+		data: kv,
+	}
+}
+
+// Set sets value to given key in session.
+func (s *SSDBStore) Set(key, val interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data[key] = val
+	return nil
+}
+
+// Get gets value by given key in session.
+func (s *SSDBStore) Get(key interface{}) interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.data[key]
+}
+
+// Delete delete a key from session.
+func (s *SSDBStore) Delete(key interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.data, key)
+	return nil
+}
+
+// ID returns current session ID.
+func (s *SSDBStore) ID() string {
+	return s.sid
+}
+
+// Data implements session.DataStore.
+func (s *SSDBStore) Data() map[interface{}]interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.data
+}
+
+// Release releases resource and save data to provider.
+func (s *SSDBStore) Release() error {
+	if len(s.data) == 0 {
+		return nil
+	}
+
+	data, err := s.p.codec.Encode(s.data)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.p.pool.do("setx", s.sid, string(data), fmt.Sprintf("%d", s.p.maxLifetime))
+	return err
+}
+
+// Flush deletes all session data.
+func (s *SSDBStore) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.data = make(map[interface{}]interface{})
+	return nil
+}
+
+// SSDBProvider represents an SSDB session provider implementation.
+type SSDBProvider struct {
+	maxLifetime int64
+	pool        *ssdbPool
+	codec       Codec
+}
+
+// Init initializes the SSDB session provider.
+// connStr: host:port, or addr=host:port;codec=secure-json
+func (p *SSDBProvider) Init(maxLifetime int64, connStr string) error {
+	p.maxLifetime = maxLifetime
+
+	addr, codecName := connStr, ""
+	poolSize := ssdbDefaultPoolSize
+	if strings.Contains(connStr, "=") {
+		params := parseConnStrParams(connStr)
+		addr, codecName = params["addr"], params["codec"]
+		if v := params["pool_size"]; v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("session/ssdb: invalid pool_size %q", v)
+			}
+			poolSize = n
+		}
+	}
+
+	codec, err := NewCodec(codecName)
+	if err != nil {
+		return err
+	}
+	p.codec = codec
+	p.pool = newSSDBPool(addr, poolSize)
+	return nil
+}
+
+// Read returns raw session store by session ID.
+func (p *SSDBProvider) Read(sid string) (session.RawStore, error) {
+	resp, err := p.pool.do("get", sid)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := make(map[interface{}]interface{})
+	if len(resp) >= 2 && resp[0] == "ok" {
+		kv, err = DecodeSessionData([]byte(resp[1]))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewSSDBStore(p, sid, kv), nil
+}
+
+// Exist returns true if session with given ID exists.
+func (p *SSDBProvider) Exist(sid string) bool {
+	resp, err := p.pool.do("exists", sid)
+	if err != nil {
+		return false
+	}
+	return len(resp) >= 2 && resp[1] == "1"
+}
+
+// Destroy deletes a session by session ID.
+func (p *SSDBProvider) Destroy(sid string) error {
+	_, err := p.pool.do("del", sid)
+	return err
+}
+
+// Regenerate regenerates a session store from old session ID to new one.
+func (p *SSDBProvider) Regenerate(oldsid, sid string) (session.RawStore, error) {
+	resp, err := p.pool.do("get", oldsid)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := make(map[interface{}]interface{})
+	if len(resp) >= 2 && resp[0] == "ok" {
+		if _, err := p.pool.do("setx", sid, resp[1], fmt.Sprintf("%d", p.maxLifetime)); err != nil {
+			return nil, err
+		}
+		kv, err = DecodeSessionData([]byte(resp[1]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := p.Destroy(oldsid); err != nil {
+		return nil, err
+	}
+
+	return NewSSDBStore(p, sid, kv), nil
+}
+
+// Count counts and returns number of sessions.
+func (p *SSDBProvider) Count() int {
+	resp, err := p.pool.do("dbsize")
+	if err != nil || len(resp) < 2 {
+		return 0
+	}
+	n := 0
+	fmt.Sscanf(resp[1], "%d", &n)
+	return n
+}
+
+// GC is a no-op: SSDB expires keys on its own once their TTL lapses.
+func (p *SSDBProvider) GC() {}
+
+func init() {
+	session.Register("ssdb", &SSDBProvider{})
+	RegisterVirtualFactory("ssdb", func() session.Provider { return &SSDBProvider{} })
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSDBWireRoundTrip(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	args := []string{"setx", "sid123", "some-gob-blob", "3600"}
+
+	go func() {
+		_ = ssdbSend(client, args)
+	}()
+
+	got, err := ssdbRecv(server)
+	assert.NoError(t, err)
+	assert.Equal(t, args, got)
+}
+
+func TestSSDBWireEmptyArg(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	args := []string{"get", ""}
+
+	go func() {
+		_ = ssdbSend(client, args)
+	}()
+
+	got, err := ssdbRecv(server)
+	assert.NoError(t, err)
+	assert.Equal(t, args, got)
+}
@@ -0,0 +1,17 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import "gitea.com/go-chi/session"
+
+// DataStore is a session.RawStore that can also hand back its whole
+// key/value map in one call. CachedProvider requires its inner provider's
+// store to implement this: without a real bulk accessor there is no safe
+// way to seed the cache from an existing session, and silently treating it
+// as empty would make the next flush destroy the session's real data.
+type DataStore interface {
+	session.RawStore
+	Data() map[interface{}]interface{}
+}
@@ -0,0 +1,255 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"code.gitea.io/gitea/models/login"
+
+	"gitea.com/go-chi/session"
+)
+
+// virtualFactories holds a constructor per provider name that the "virtual"
+// provider is allowed to dispatch to. A real provider registers itself here
+// in addition to calling session.Register, since VirtualSessionProvider
+// needs to spin up its own private instances on demand rather than share
+// the single instance session.Register keeps for direct use.
+var virtualFactories = map[string]func() session.Provider{}
+
+// RegisterVirtualFactory makes a session provider usable as a backend of
+// the "virtual" provider under the given name.
+func RegisterVirtualFactory(name string, factory func() session.Provider) {
+	virtualFactories[name] = factory
+}
+
+// VirtualStore forwards every operation to whichever real store currently
+// owns the session.
+type VirtualStore struct {
+	session.RawStore
+}
+
+// Data implements session.DataStore by forwarding to the wrapped store,
+// e.g. so "cached" can sit in front of "virtual". Embedding an interface
+// field only promotes the methods of that interface, not extra ones the
+// concrete value underneath happens to have, so this has to be written out
+// rather than relying on promotion. A sub-provider whose store doesn't
+// implement session.DataStore would otherwise make CachedProvider treat
+// the session as silently empty and destroy it on the next flush, so this
+// panics instead of doing that.
+func (s *VirtualStore) Data() map[interface{}]interface{} {
+	ds, ok := s.RawStore.(DataStore)
+	if !ok {
+		panic(fmt.Sprintf("session/virtual: sub-provider store %T does not implement session.DataStore", s.RawStore))
+	}
+	return ds.Data()
+}
+
+// VirtualSessionProvider is a thin dispatcher in front of the other
+// registered session providers. It lets `provider` be changed in app.ini
+// without losing sessions created under the previously configured backend:
+// each session remembers, in the DB, which backend it was created under,
+// and VirtualSessionProvider keeps routing to that backend until the
+// session expires. Newly created sessions always go to the currently
+// configured provider. provider_config is passed to the currently configured
+// provider only; any other backend a session is routed to is initialized
+// with an empty config, i.e. with that provider's own defaults.
+type VirtualSessionProvider struct {
+	maxLifetime int64
+	current     string
+	currentConf string
+
+	lock      sync.RWMutex
+	providers map[string]session.Provider
+}
+
+// Init initializes the virtual session provider.
+// connStr: provider=redis;provider_config=network=tcp,addr=127.0.0.1:6379
+func (p *VirtualSessionProvider) Init(maxLifetime int64, connStr string) error {
+	p.maxLifetime = maxLifetime
+	p.providers = make(map[string]session.Provider)
+
+	params := parseConnStrParams(connStr)
+	p.current = params["provider"]
+	p.currentConf = params["provider_config"]
+
+	if p.current == "" {
+		return fmt.Errorf("session/virtual: connStr is missing provider=")
+	}
+
+	_, err := p.providerFor(p.current)
+	return err
+}
+
+// providerFor lazily constructs and initializes the named sub-provider.
+func (p *VirtualSessionProvider) providerFor(name string) (session.Provider, error) {
+	p.lock.RLock()
+	sp, ok := p.providers[name]
+	p.lock.RUnlock()
+	if ok {
+		return sp, nil
+	}
+
+	factory, ok := virtualFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("session/virtual: unknown sub-provider %q", name)
+	}
+
+	conf := ""
+	if name == p.current {
+		conf = p.currentConf
+	}
+
+	sp = factory()
+	if err := sp.Init(p.maxLifetime, conf); err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	p.providers[name] = sp
+	p.lock.Unlock()
+	return sp, nil
+}
+
+// ownerOf returns which provider a given session id belongs to and whether
+// that mapping was already recorded, falling back to the currently
+// configured provider for sessions with no recorded owner yet (e.g. brand
+// new sids).
+func (p *VirtualSessionProvider) ownerOf(sid string) (name string, recorded bool, err error) {
+	name, err = login.GetSessionProvider(sid)
+	if err != nil {
+		return "", false, err
+	}
+	if name == "" {
+		return p.current, false, nil
+	}
+	return name, true, nil
+}
+
+// Read returns raw session store by session ID, forwarded to whichever
+// provider owns it. The sid->provider mapping is only written on first
+// touch or when ownership actually changed, not on every Read, so a hot
+// session doesn't cost a DB write per request on top of whatever the
+// owning provider itself does.
+func (p *VirtualSessionProvider) Read(sid string) (session.RawStore, error) {
+	name, recorded, err := p.ownerOf(sid)
+	if err != nil {
+		return nil, err
+	}
+
+	sp, err := p.providerFor(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !recorded {
+		if err := login.SetSessionProvider(sid, name, p.maxLifetime); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := sp.Read(sid)
+	if err != nil {
+		return nil, err
+	}
+	return &VirtualStore{raw}, nil
+}
+
+// Exist returns true if session with given ID exists under its owning
+// provider.
+func (p *VirtualSessionProvider) Exist(sid string) bool {
+	name, _, err := p.ownerOf(sid)
+	if err != nil {
+		return false
+	}
+
+	sp, err := p.providerFor(name)
+	if err != nil {
+		return false
+	}
+	return sp.Exist(sid)
+}
+
+// Destroy deletes a session by session ID from its owning provider.
+func (p *VirtualSessionProvider) Destroy(sid string) error {
+	name, _, err := p.ownerOf(sid)
+	if err != nil {
+		return err
+	}
+
+	sp, err := p.providerFor(name)
+	if err != nil {
+		return err
+	}
+
+	if err := sp.Destroy(sid); err != nil {
+		return err
+	}
+	return login.DeleteSessionProvider(sid)
+}
+
+// Regenerate regenerates a session store from old session ID to new one,
+// keeping it on the provider it already belongs to.
+func (p *VirtualSessionProvider) Regenerate(oldsid, sid string) (session.RawStore, error) {
+	name, _, err := p.ownerOf(oldsid)
+	if err != nil {
+		return nil, err
+	}
+
+	sp, err := p.providerFor(name)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := sp.Regenerate(oldsid, sid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := login.RenameSessionProvider(oldsid, sid, p.maxLifetime); err != nil {
+		return nil, err
+	}
+	return &VirtualStore{raw}, nil
+}
+
+// Count counts and returns the number of sessions across every sub-provider
+// that has been used since this process started.
+func (p *VirtualSessionProvider) Count() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	total := 0
+	for _, sp := range p.providers {
+		total += sp.Count()
+	}
+	return total
+}
+
+// GC calls GC on every sub-provider that has been used so far, and prunes
+// expired rows from the sid->provider mapping table so it doesn't grow
+// forever: nothing else deletes a row there once its session has expired
+// rather than been explicitly destroyed.
+func (p *VirtualSessionProvider) GC() {
+	p.lock.RLock()
+	providers := make([]session.Provider, 0, len(p.providers))
+	for _, sp := range p.providers {
+		providers = append(providers, sp)
+	}
+	p.lock.RUnlock()
+
+	for _, sp := range providers {
+		sp.GC()
+	}
+
+	if err := login.CleanupSessionProviders(); err != nil {
+		log.Printf("session/virtual: error garbage collecting session_provider: %v", err)
+	}
+}
+
+func init() {
+	session.Register("virtual", &VirtualSessionProvider{})
+}
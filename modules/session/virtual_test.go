@@ -0,0 +1,73 @@
+// Copyright 2021 The Gitea Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package session
+
+import (
+	"testing"
+
+	"code.gitea.io/gitea/models/login"
+	"code.gitea.io/gitea/models/unittest"
+
+	"gitea.com/go-chi/session"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualSessionProviderReadRecordsOwnerOnFirstTouch(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	fake := newFakeProvider()
+	RegisterVirtualFactory("fake-virtual-read", func() session.Provider { return fake })
+
+	p := &VirtualSessionProvider{}
+	assert.NoError(t, p.Init(3600, "provider=fake-virtual-read"))
+
+	sid := "virtual-repeat-sid"
+	assert.NoError(t, login.DeleteSessionProvider(sid))
+
+	_, recorded, err := p.ownerOf(sid)
+	assert.NoError(t, err)
+	assert.False(t, recorded, "a brand new sid has no recorded owner yet")
+
+	_, err = p.Read(sid)
+	assert.NoError(t, err)
+
+	name, recorded, err := p.ownerOf(sid)
+	assert.NoError(t, err)
+	assert.True(t, recorded, "Read must record ownership on first touch")
+	assert.Equal(t, "fake-virtual-read", name)
+
+	// A second Read, now that the owner is already recorded, takes the path
+	// that skips the mapping write; this only checks that it still behaves
+	// like a normal Read, not that the write was skipped.
+	_, err = p.Read(sid)
+	assert.NoError(t, err)
+}
+
+func TestVirtualSessionProviderRegenerateKeepsOwningProvider(t *testing.T) {
+	assert.NoError(t, unittest.PrepareTestDatabase())
+
+	fake := newFakeProvider()
+	RegisterVirtualFactory("fake-virtual-regen", func() session.Provider { return fake })
+
+	p := &VirtualSessionProvider{}
+	assert.NoError(t, p.Init(3600, "provider=fake-virtual-regen"))
+
+	oldsid, sid := "virtual-old-sid", "virtual-new-sid"
+	assert.NoError(t, login.DeleteSessionProvider(oldsid))
+	assert.NoError(t, login.DeleteSessionProvider(sid))
+
+	raw, err := p.Read(oldsid)
+	assert.NoError(t, err)
+	assert.NoError(t, raw.Set("k", "v"))
+	assert.NoError(t, raw.Release())
+
+	_, err = p.Regenerate(oldsid, sid)
+	assert.NoError(t, err)
+
+	provider, err := login.GetSessionProvider(sid)
+	assert.NoError(t, err)
+	assert.Equal(t, "fake-virtual-regen", provider)
+}